@@ -4,6 +4,7 @@
 package nix
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -11,8 +12,14 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
 	"go.jetpack.io/devbox/internal/boxcli/usererr"
 	"go.jetpack.io/devbox/internal/debug"
 	"go.jetpack.io/devbox/internal/redact"
@@ -35,17 +42,17 @@ type ProfileInstallArgs struct {
 	Offline     bool
 	ProfilePath string
 	Writer      io.Writer
+
+	// Priority optionally pins this installable to an exact nix profile
+	// priority, e.g. when snapshot.Restore needs to reproduce the exact
+	// priorities a profile was built with. Leave nil to let
+	// ProfileInstallBatch assign one automatically.
+	Priority *int
 }
 
 func ProfileInstall(ctx context.Context, args *ProfileInstallArgs) error {
-	if !IsInsecureAllowed() && PackageIsInsecure(args.Installable) {
-		knownVulnerabilities := PackageKnownVulnerabilities(args.Installable)
-		errString := fmt.Sprintf("Package %s is insecure. \n\n", args.Installable)
-		if len(knownVulnerabilities) > 0 {
-			errString += fmt.Sprintf("Known vulnerabilities: %s \n\n", knownVulnerabilities)
-		}
-		errString += "To override use `devbox add <pkg> --allow-insecure`"
-		return usererr.New(errString)
+	if err := checkInsecureAllowed(args.Installable); err != nil {
+		return err
 	}
 
 	cmd := commandContext(
@@ -75,6 +82,243 @@ func ProfileInstall(ctx context.Context, args *ProfileInstallArgs) error {
 	return cmd.Run()
 }
 
+func checkInsecureAllowed(installable string) error {
+	if IsInsecureAllowed() || !PackageIsInsecure(installable) {
+		return nil
+	}
+	knownVulnerabilities := PackageKnownVulnerabilities(installable)
+	errString := fmt.Sprintf("Package %s is insecure. \n\n", installable)
+	if len(knownVulnerabilities) > 0 {
+		errString += fmt.Sprintf("Known vulnerabilities: %s \n\n", knownVulnerabilities)
+	}
+	errString += "To override use `devbox add <pkg> --allow-insecure`"
+	return usererr.New(errString)
+}
+
+// maxProfileInstallAttempts bounds how many times ProfileInstallBatch will
+// retry a single `nix profile install` invocation that failed with a
+// known-transient error.
+const maxProfileInstallAttempts = 4
+
+// MaxConcurrentProfileInstalls bounds how many `nix profile install`
+// processes ProfileInstallBatch runs at once. It only applies when a batch
+// can't be installed in a single invocation because its packages need
+// distinct priorities. Defaults to one per CPU.
+var MaxConcurrentProfileInstalls = runtime.NumCPU()
+
+// ProfileInstallBatch installs many installables into one or more profiles.
+// A profile's batch is issued as a single `nix profile install` only when
+// there's exactly one installable to install; any profile with two or more
+// installables, or one that needs a specific Priority (e.g. during
+// snapshot.Restore), falls back to a bounded worker pool, one `nix profile
+// install` per package, so each gets its own strictly-increasing priority.
+// Every invocation is retried with exponential backoff on known-transient
+// errors -- substituter 5xx responses, unexpected EOF, TLS handshake
+// failures -- instead of aborting the whole batch.
+func ProfileInstallBatch(ctx context.Context, batch []*ProfileInstallArgs) error {
+	for _, args := range batch {
+		if err := checkInsecureAllowed(args.Installable); err != nil {
+			return err
+		}
+	}
+
+	byProfile := map[string][]*ProfileInstallArgs{}
+	var order []string
+	for _, args := range batch {
+		if _, ok := byProfile[args.ProfilePath]; !ok {
+			order = append(order, args.ProfilePath)
+		}
+		byProfile[args.ProfilePath] = append(byProfile[args.ProfilePath], args)
+	}
+
+	for _, profilePath := range order {
+		if err := profileInstallGroup(ctx, profilePath, byProfile[profilePath]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func profileInstallGroup(ctx context.Context, profilePath string, group []*ProfileInstallArgs) error {
+	base, err := nextPriorityValue(profilePath)
+	if err != nil {
+		return err
+	}
+
+	if canBatchGroupAsOne(group) {
+		return installAllAtOnce(ctx, profilePath, group, base+1)
+	}
+	return installOneByOne(ctx, group, base)
+}
+
+// canBatchGroupAsOne reports whether group can be installed with a single
+// `nix profile install` invocation. nix profile install only accepts one
+// --priority per invocation, so a single-command batch would assign every
+// installable in the group the same priority. That's fine for a lone
+// installable, but for two or more it breaks devbox's usual
+// strictly-increasing priorities and can make nix itself reject the batch
+// with a priority conflict (e.g. two packages that both provide
+// bin/python3), so only a group of exactly one ever batches as one.
+func canBatchGroupAsOne(group []*ProfileInstallArgs) bool {
+	if len(group) != 1 {
+		return false
+	}
+	return group[0].Priority == nil
+}
+
+// installAllAtOnce issues a single `nix profile install` for every
+// installable in group, all sharing the same new priority. Only called when
+// group has exactly one installable.
+func installAllAtOnce(ctx context.Context, profilePath string, group []*ProfileInstallArgs, priority int) error {
+	installables := make([]string, len(group))
+	for i, args := range group {
+		installables[i] = args.Installable
+	}
+
+	return withRetry(ctx, maxProfileInstallAttempts, func() error {
+		cmd := commandContext(
+			ctx,
+			"profile", "install",
+			"--profile", profilePath,
+			"--impure",
+			"--priority", fmt.Sprintf("%d", priority),
+		)
+		if group[0].Offline {
+			cmd.Args = append(cmd.Args, "--offline")
+		}
+		cmd.Args = append(cmd.Args, installables...)
+		cmd.Env = allowUnfreeEnv(os.Environ())
+
+		var captured bytes.Buffer
+		writers := append(groupWriters(group), &captured)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = io.MultiWriter(writers...)
+		cmd.Stderr = cmd.Stdout
+
+		debug.Log("running command: %s\n", cmd)
+		return wrapIfTransient(cmd.Run(), captured.String())
+	})
+}
+
+// installOneByOne installs each installable in group with its own `nix
+// profile install`, bounded to MaxConcurrentProfileInstalls concurrent
+// processes. Priorities are computed once from base rather than by calling
+// nextPriority per package, since doing that concurrently would race.
+func installOneByOne(ctx context.Context, group []*ProfileInstallArgs, base int) error {
+	g, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, MaxConcurrentProfileInstalls)
+
+	for i, args := range group {
+		args, priority := args, base+1+i
+		if args.Priority != nil {
+			priority = *args.Priority
+		}
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			return withRetry(ctx, maxProfileInstallAttempts, func() error {
+				return installOne(ctx, args, priority)
+			})
+		})
+	}
+	return g.Wait()
+}
+
+func installOne(ctx context.Context, args *ProfileInstallArgs, priority int) error {
+	cmd := commandContext(
+		ctx,
+		"profile", "install",
+		"--profile", args.ProfilePath,
+		"--impure",
+		"--priority", fmt.Sprintf("%d", priority),
+	)
+	if args.Offline {
+		cmd.Args = append(cmd.Args, "--offline")
+	}
+	cmd.Args = append(cmd.Args, args.Installable)
+	cmd.Env = allowUnfreeEnv(os.Environ())
+
+	var captured bytes.Buffer
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(args.Writer, &captured)
+	cmd.Stderr = cmd.Stdout
+
+	debug.Log("running command: %s\n", cmd)
+	return wrapIfTransient(cmd.Run(), captured.String())
+}
+
+func groupWriters(group []*ProfileInstallArgs) []io.Writer {
+	writers := make([]io.Writer, 0, len(group))
+	seen := make(map[io.Writer]bool, len(group))
+	for _, args := range group {
+		if args.Writer == nil || seen[args.Writer] {
+			continue
+		}
+		seen[args.Writer] = true
+		writers = append(writers, args.Writer)
+	}
+	return writers
+}
+
+// transientInstallError marks an error as worth retrying.
+type transientInstallError struct{ err error }
+
+func (e *transientInstallError) Error() string { return e.err.Error() }
+func (e *transientInstallError) Unwrap() error { return e.err }
+
+// transientErrorSubstrings are lowercased substrings of known-transient
+// failures from substituters: HTTP 5xx responses, truncated connections,
+// and TLS handshake failures.
+var transientErrorSubstrings = []string{
+	"http error 5",
+	"http response code 5",
+	"unexpected eof",
+	"tls handshake",
+	"connection reset by peer",
+}
+
+func wrapIfTransient(err error, output string) error {
+	if err == nil {
+		return nil
+	}
+	lower := strings.ToLower(output)
+	for _, substr := range transientErrorSubstrings {
+		if strings.Contains(lower, substr) {
+			return &transientInstallError{err}
+		}
+	}
+	return err
+}
+
+// retryBaseDelay is the initial backoff withRetry waits after a transient
+// failure, doubling on each subsequent attempt. It's a var (rather than a
+// const) so tests can shrink it to avoid sleeping in real time.
+var retryBaseDelay = 500 * time.Millisecond
+
+// withRetry calls fn until it succeeds, fn returns a non-transient error, or
+// attempts calls have been made, backing off exponentially between tries.
+func withRetry(ctx context.Context, attempts int, fn func() error) error {
+	var err error
+	wait := retryBaseDelay
+	for i := 0; i < attempts; i++ {
+		err = fn()
+		var transient *transientInstallError
+		if err == nil || !errors.As(err, &transient) {
+			return err
+		}
+		if i == attempts-1 {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait *= 2
+	}
+	return err
+}
+
 func ProfileRemove(profilePath string, indexes ...string) error {
 	cmd := command(
 		append([]string{
@@ -92,10 +336,18 @@ func ProfileRemove(profilePath string, indexes ...string) error {
 	return nil
 }
 
+// manifestElement holds the fields of a profile manifest element that devbox
+// cares about, regardless of whether it came from the legacy (list) or
+// modern (map) manifest.json schema.
+type manifestElement struct {
+	Priority   int
+	AttrPath   string
+	Url        string
+	StorePaths []string
+}
+
 type manifest struct {
-	Elements []struct {
-		Priority int
-	}
+	Elements []manifestElement
 }
 
 func readManifest(profilePath string) (manifest, error) {
@@ -107,25 +359,42 @@ func readManifest(profilePath string) (manifest, error) {
 		return manifest{}, err
 	}
 
+	type rawElement struct {
+		Priority   int      `json:"priority"`
+		AttrPath   string   `json:"attrPath"`
+		Url        string   `json:"url"`
+		StorePaths []string `json:"storePaths"`
+	}
+
 	type manifestModern struct {
-		Elements map[string]struct {
-			Priority int `json:"priority"`
-		} `json:"elements"`
+		Elements map[string]rawElement `json:"elements"`
 	}
 	var modernMani manifestModern
 	if err := json.Unmarshal(data, &modernMani); err == nil {
-		// Convert to the result format
+		// Convert to the result format. Map iteration order is randomized, so
+		// without an explicit sort the element order (and anything derived
+		// from it, like Snapshot.Elements) would vary between otherwise
+		// identical reads of the same manifest.
 		result := manifest{}
 		for _, e := range modernMani.Elements {
-			result.Elements = append(result.Elements, struct{ Priority int }{e.Priority})
+			result.Elements = append(result.Elements, manifestElement{
+				Priority:   e.Priority,
+				AttrPath:   e.AttrPath,
+				Url:        e.Url,
+				StorePaths: e.StorePaths,
+			})
 		}
+		sort.Slice(result.Elements, func(i, j int) bool {
+			if result.Elements[i].Priority != result.Elements[j].Priority {
+				return result.Elements[i].Priority < result.Elements[j].Priority
+			}
+			return result.Elements[i].AttrPath < result.Elements[j].AttrPath
+		})
 		return result, nil
 	}
 
 	type manifestLegacy struct {
-		Elements []struct {
-			Priority int `json:"priority"`
-		} `json:"elements"`
+		Elements []rawElement `json:"elements"`
 	}
 	var legacyMani manifestLegacy
 	if err := json.Unmarshal(data, &legacyMani); err != nil {
@@ -135,23 +404,77 @@ func readManifest(profilePath string) (manifest, error) {
 	// Convert to the result format
 	result := manifest{}
 	for _, e := range legacyMani.Elements {
-		result.Elements = append(result.Elements, struct{ Priority int }{e.Priority})
+		result.Elements = append(result.Elements, manifestElement{
+			Priority:   e.Priority,
+			AttrPath:   e.AttrPath,
+			Url:        e.Url,
+			StorePaths: e.StorePaths,
+		})
 	}
 	return result, nil
 }
 
+// ProfileManifestElement is the subset of a profile manifest element that's
+// useful to callers outside this package, e.g. internal/snapshot.
+type ProfileManifestElement struct {
+	FlakeRef   string
+	StorePaths []string
+	Priority   int
+}
+
+// ProfileManifest reads and returns every element currently installed into
+// the profile at profilePath. Order is deterministic across repeated reads
+// of an unchanged manifest.json: the legacy (list) schema keeps the file's
+// own order, and the modern (map) schema -- whose Go decode order is
+// otherwise randomized -- is sorted by Priority then AttrPath.
+func ProfileManifest(profilePath string) ([]ProfileManifestElement, error) {
+	m, err := readManifest(profilePath)
+	if err != nil {
+		return nil, redact.Errorf("read profile manifest: %v", err)
+	}
+
+	elements := make([]ProfileManifestElement, 0, len(m.Elements))
+	for _, e := range m.Elements {
+		flakeRef := e.Url
+		if flakeRef == "" {
+			flakeRef = e.AttrPath
+		}
+		elements = append(elements, ProfileManifestElement{
+			FlakeRef:   flakeRef,
+			StorePaths: e.StorePaths,
+			Priority:   e.Priority,
+		})
+	}
+	return elements, nil
+}
+
 const DefaultPriority = 5
 
 func nextPriority(profilePath string) string {
 	// error is ignored because it's ok if the file doesn't exist
-	m, _ := readManifest(profilePath)
+	max, _ := nextPriorityValue(profilePath)
+	// Each subsequent package gets a lower priority. This matches how flake.nix
+	// behaves
+	return fmt.Sprintf("%d", max+1)
+}
+
+// nextPriorityValue returns the highest priority currently in profilePath's
+// manifest, or DefaultPriority if the manifest is missing, empty, or has no
+// element with a priority above DefaultPriority. Callers that need to
+// assign priorities to more than one package at once, like
+// ProfileInstallBatch, should call this once and derive each package's
+// priority from the result instead of calling nextPriority per package,
+// which would race when installs run concurrently.
+func nextPriorityValue(profilePath string) (int, error) {
+	m, err := readManifest(profilePath)
+	if err != nil {
+		return DefaultPriority, err
+	}
 	max := DefaultPriority
 	for _, e := range m.Elements {
 		if e.Priority > max {
 			max = e.Priority
 		}
 	}
-	// Each subsequent package gets a lower priority. This matches how flake.nix
-	// behaves
-	return fmt.Sprintf("%d", max+1)
+	return max, nil
 }
@@ -0,0 +1,228 @@
+// Copyright 2023 Jetpack Technologies Inc and contributors. All rights reserved.
+// Use of this source code is governed by the license in the LICENSE file.
+
+package nix
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNextPriorityValue_NoManifest(t *testing.T) {
+	profilePath := t.TempDir()
+
+	got, err := nextPriorityValue(profilePath)
+	if err != nil {
+		t.Fatalf("nextPriorityValue: %v", err)
+	}
+	if got != DefaultPriority {
+		t.Fatalf("got priority %d, want DefaultPriority %d", got, DefaultPriority)
+	}
+}
+
+func TestNextPriorityValue_ModernManifest(t *testing.T) {
+	profilePath := t.TempDir()
+	manifestJSON := `{
+		"elements": {
+			"pkg-a": {"priority": 5, "attrPath": "a", "storePaths": ["/nix/store/aaa-a"]},
+			"pkg-b": {"priority": 9, "attrPath": "b", "storePaths": ["/nix/store/bbb-b"]}
+		}
+	}`
+	if err := os.WriteFile(filepath.Join(profilePath, "manifest.json"), []byte(manifestJSON), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := nextPriorityValue(profilePath)
+	if err != nil {
+		t.Fatalf("nextPriorityValue: %v", err)
+	}
+	if got != 9 {
+		t.Fatalf("got priority %d, want 9 (the highest priority element)", got)
+	}
+}
+
+// TestProfileManifest_PreservesPerElementPriority guards the bug where
+// snapshot.Restore silently dropped recorded priorities: ProfileManifest
+// must round-trip each element's own priority, not just the overall max.
+func TestProfileManifest_PreservesPerElementPriority(t *testing.T) {
+	profilePath := t.TempDir()
+	manifestJSON := `{
+		"elements": [
+			{"priority": 3, "attrPath": "a", "url": "flake:a", "storePaths": ["/nix/store/aaa-a"]},
+			{"priority": 7, "attrPath": "b", "url": "flake:b", "storePaths": ["/nix/store/bbb-b"]}
+		]
+	}`
+	if err := os.WriteFile(filepath.Join(profilePath, "manifest.json"), []byte(manifestJSON), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	elements, err := ProfileManifest(profilePath)
+	if err != nil {
+		t.Fatalf("ProfileManifest: %v", err)
+	}
+	if len(elements) != 2 {
+		t.Fatalf("got %d elements, want 2", len(elements))
+	}
+	byRef := map[string]int{}
+	for _, e := range elements {
+		byRef[e.FlakeRef] = e.Priority
+	}
+	if byRef["flake:a"] != 3 || byRef["flake:b"] != 7 {
+		t.Fatalf("priorities not preserved per element, got %#v", byRef)
+	}
+}
+
+// TestCanBatchGroupAsOne guards the regression where a whole multi-package
+// batch was installed with one shared priority: only a lone installable
+// (with no pinned Priority) may use the single-invocation path.
+func TestCanBatchGroupAsOne(t *testing.T) {
+	priority := 5
+
+	cases := []struct {
+		name  string
+		group []*ProfileInstallArgs
+		want  bool
+	}{
+		{
+			name:  "single installable",
+			group: []*ProfileInstallArgs{{Installable: "a"}},
+			want:  true,
+		},
+		{
+			name:  "single installable with pinned priority",
+			group: []*ProfileInstallArgs{{Installable: "a", Priority: &priority}},
+			want:  false,
+		},
+		{
+			name: "multiple installables",
+			group: []*ProfileInstallArgs{
+				{Installable: "a"},
+				{Installable: "b"},
+			},
+			want: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := canBatchGroupAsOne(c.group); got != c.want {
+				t.Fatalf("canBatchGroupAsOne() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+// TestProfileManifest_ModernManifestOrderIsDeterministic guards the bug
+// where the modern (map) manifest.json schema's randomized map iteration
+// order leaked into ProfileManifest's result, making repeated Snapshot.Build
+// calls against an unchanged profile produce spuriously different element
+// order.
+func TestProfileManifest_ModernManifestOrderIsDeterministic(t *testing.T) {
+	profilePath := t.TempDir()
+	manifestJSON := `{
+		"elements": {
+			"pkg-c": {"priority": 5, "attrPath": "c", "storePaths": ["/nix/store/ccc-c"]},
+			"pkg-a": {"priority": 5, "attrPath": "a", "storePaths": ["/nix/store/aaa-a"]},
+			"pkg-b": {"priority": 3, "attrPath": "b", "storePaths": ["/nix/store/bbb-b"]}
+		}
+	}`
+	if err := os.WriteFile(filepath.Join(profilePath, "manifest.json"), []byte(manifestJSON), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		elements, err := ProfileManifest(profilePath)
+		if err != nil {
+			t.Fatalf("ProfileManifest: %v", err)
+		}
+		if len(elements) != 3 {
+			t.Fatalf("got %d elements, want 3", len(elements))
+		}
+		// Sorted by Priority then AttrPath: pkg-b (priority 3, "b"), then
+		// pkg-a and pkg-c (both priority 5, ordered by AttrPath "a" < "c").
+		want := []string{"b", "a", "c"}
+		for j, e := range elements {
+			if e.FlakeRef != want[j] {
+				t.Fatalf("run %d: got order %v, want %v", i, attrPaths(elements), want)
+			}
+		}
+	}
+}
+
+func attrPaths(elements []ProfileManifestElement) []string {
+	out := make([]string, len(elements))
+	for i, e := range elements {
+		out[i] = e.FlakeRef
+	}
+	return out
+}
+
+func TestWrapIfTransient(t *testing.T) {
+	base := errors.New("boom")
+
+	cases := []struct {
+		name      string
+		output    string
+		transient bool
+	}{
+		{"http 5xx", "error: HTTP error 502 while fetching", true},
+		{"unexpected eof", "fetching substituter: unexpected EOF", true},
+		{"tls handshake", "remote: TLS handshake failed", true},
+		{"not found is not transient", "error: path '/nix/store/x' does not exist", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := wrapIfTransient(base, c.output)
+			var transient *transientInstallError
+			got := errors.As(err, &transient)
+			if got != c.transient {
+				t.Fatalf("wrapIfTransient(%q) transient=%v, want %v", c.output, got, c.transient)
+			}
+		})
+	}
+}
+
+func TestWithRetry_RetriesTransientThenSucceeds(t *testing.T) {
+	attempts := 0
+	err := withRetryForTest(context.Background(), 3, func() error {
+		attempts++
+		if attempts < 3 {
+			return wrapIfTransient(errors.New("boom"), "unexpected EOF")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withRetry: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("got %d attempts, want 3", attempts)
+	}
+}
+
+func TestWithRetry_StopsOnNonTransientError(t *testing.T) {
+	attempts := 0
+	wantErr := errors.New("permanent failure")
+	err := withRetryForTest(context.Background(), 3, func() error {
+		attempts++
+		return wantErr
+	})
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("withRetry returned %v, want %v", err, wantErr)
+	}
+	if attempts != 1 {
+		t.Fatalf("got %d attempts, want 1 (should not retry non-transient errors)", attempts)
+	}
+}
+
+// withRetryForTest calls withRetry with near-zero backoff so the retry
+// tests don't sleep in real time.
+func withRetryForTest(ctx context.Context, attempts int, fn func() error) error {
+	orig := retryBaseDelay
+	retryBaseDelay = 0
+	defer func() { retryBaseDelay = orig }()
+	return withRetry(ctx, attempts, fn)
+}
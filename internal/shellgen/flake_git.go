@@ -0,0 +1,98 @@
+// Copyright 2023 Jetpack Technologies Inc and contributors. All rights reserved.
+// Use of this source code is governed by the license in the LICENSE file.
+
+package shellgen
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/pkg/errors"
+
+	"go.jetpack.io/devbox/internal/debug"
+	"go.jetpack.io/devbox/internal/redact"
+)
+
+// ensureFlakeFilesTracked makes sure every path in relPaths (relative to
+// flakeDir) is tracked by git, since Nix refuses to build a flake with
+// untracked inputs. It replaces the old `git init` + `git add` bootstrap,
+// which broke as soon as flakeDir lived inside a worktree, a submodule, or
+// any layout where `.git` is a file pointing elsewhere rather than a
+// directory -- isProjectInGitRepo only ever looked for a `.git` directory.
+//
+// Only repo/worktree/gitdir *detection* goes through go-git, via
+// DetectDotGit, so it resolves `.git` files (worktrees, submodules,
+// `$GIT_DIR` elsewhere) the same way the git CLI does -- that was the part
+// that broke under the old `.git`-directory-only check. The actual staging
+// step still shells out to the git CLI: go-git's Worktree.Add stages a
+// file's full content, and its public API has no equivalent of `git add
+// --intent-to-add`'s empty-placeholder staging, so there's no way to get
+// that behavior from the library alone. Staging goes through that repo's
+// real gitdir -- this only touches the index, not flakeDir itself, so it
+// can't turn a submodule or worktree into a nested repo. `--intent-to-add`
+// doesn't run hooks or invoke commit signing, so there's nothing for a
+// configured core.hooksPath or commit.gpgsign to interfere with.
+func ensureFlakeFilesTracked(flakeDir string, relPaths []string) error {
+	repo, err := git.PlainOpenWithOptions(flakeDir, &git.PlainOpenOptions{DetectDotGit: true})
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		// Not inside a git repository at all: Nix's requirement doesn't
+		// apply, so carry on.
+		return nil
+	}
+	if err != nil {
+		return redact.Errorf("open enclosing git repository for %s: %v", redact.Safe(flakeDir), err)
+	}
+
+	worktree, err := repo.Worktree()
+	if errors.Is(err, git.ErrIsBareRepository) {
+		// No working tree to stage these files into; fall back cleanly.
+		return nil
+	}
+	if err != nil {
+		return redact.Errorf("open git worktree for %s: %v", redact.Safe(flakeDir), err)
+	}
+
+	gitDir, err := repoGitDir(repo)
+	if err != nil {
+		return err
+	}
+
+	for _, relPath := range relPaths {
+		absPath := filepath.Join(flakeDir, relPath)
+		repoRelPath, err := filepath.Rel(worktree.Filesystem.Root(), absPath)
+		if err != nil {
+			return redact.Errorf("resolve %s relative to worktree root: %v", redact.Safe(absPath), err)
+		}
+
+		cmd := exec.Command(
+			"git",
+			"--git-dir", gitDir,
+			"--work-tree", worktree.Filesystem.Root(),
+			"add", "--intent-to-add", "--",
+			repoRelPath,
+		)
+		if debug.IsEnabled() {
+			cmd.Stdin = os.Stdin
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+		}
+		if err := cmd.Run(); err != nil {
+			return redact.Errorf("git add --intent-to-add %s: %v", redact.Safe(repoRelPath), err)
+		}
+	}
+	return nil
+}
+
+// repoGitDir returns the real on-disk gitdir backing repo, resolving
+// worktree/submodule `.git` file indirection the same way go-git's
+// DetectDotGit did when opening it.
+func repoGitDir(repo *git.Repository) (string, error) {
+	storage, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return "", redact.Errorf("unsupported git storage backend %T", repo.Storer)
+	}
+	return storage.Filesystem().Root(), nil
+}
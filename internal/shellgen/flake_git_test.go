@@ -0,0 +1,147 @@
+// Copyright 2023 Jetpack Technologies Inc and contributors. All rights reserved.
+// Use of this source code is governed by the license in the LICENSE file.
+
+package shellgen
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+// assertIntentToAdd checks that relPath shows up as a new file staged for
+// commit in repoDir, the way `git add --intent-to-add` leaves it.
+func assertIntentToAdd(t *testing.T, repoDir, relPath string) {
+	t.Helper()
+	cmd := exec.Command("git", "status", "--porcelain", "--", relPath)
+	cmd.Dir = repoDir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git status: %v\n%s", err, out)
+	}
+	if len(out) == 0 {
+		t.Fatalf("expected %s to be staged (intent-to-add) in %s, got no status output", relPath, repoDir)
+	}
+	// An untracked file also shows up, as "?? <path>"; an intent-to-add one
+	// shows as " A <path>".
+	if !strings.HasPrefix(string(out), " A ") {
+		t.Fatalf("expected %s to be staged (intent-to-add) in %s, got status %q", relPath, repoDir, out)
+	}
+}
+
+func writeFlakeNix(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "flake.nix"), []byte("{ }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnsureFlakeFilesTracked_PlainRepo(t *testing.T) {
+	repoDir := t.TempDir()
+	runGit(t, repoDir, "init")
+	writeFlakeNix(t, repoDir)
+
+	if err := ensureFlakeFilesTracked(repoDir, []string{"flake.nix"}); err != nil {
+		t.Fatalf("ensureFlakeFilesTracked: %v", err)
+	}
+	assertIntentToAdd(t, repoDir, "flake.nix")
+}
+
+// TestEnsureFlakeFilesTracked_Worktree covers a flake dir that lives inside a
+// linked worktree, where .git is a file (not a directory) pointing at the
+// main repo's gitdir/worktrees/<name> directory.
+func TestEnsureFlakeFilesTracked_Worktree(t *testing.T) {
+	mainDir := t.TempDir()
+	runGit(t, mainDir, "init")
+	runGit(t, mainDir, "commit", "--allow-empty", "-m", "init")
+
+	worktreeDir := filepath.Join(t.TempDir(), "wt")
+	runGit(t, mainDir, "worktree", "add", "-b", "wt-branch", worktreeDir)
+
+	flakeDir := filepath.Join(worktreeDir, "sub")
+	if err := os.MkdirAll(flakeDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFlakeNix(t, flakeDir)
+
+	if err := ensureFlakeFilesTracked(flakeDir, []string{"flake.nix"}); err != nil {
+		t.Fatalf("ensureFlakeFilesTracked: %v", err)
+	}
+	assertIntentToAdd(t, worktreeDir, "sub/flake.nix")
+
+	// The main repo's working tree must be untouched: no nested repo, no
+	// commits, no staged changes leaked into it.
+	cmd := exec.Command("git", "status", "--porcelain")
+	cmd.Dir = mainDir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git status: %v\n%s", err, out)
+	}
+	if len(out) != 0 {
+		t.Fatalf("expected main repo to be clean, got:\n%s", out)
+	}
+}
+
+// TestEnsureFlakeFilesTracked_Submodule covers a flake dir that lives inside
+// a git submodule, where .git is a file pointing at
+// <superproject>/.git/modules/<name>.
+func TestEnsureFlakeFilesTracked_Submodule(t *testing.T) {
+	subRepoDir := t.TempDir()
+	runGit(t, subRepoDir, "init")
+	runGit(t, subRepoDir, "commit", "--allow-empty", "-m", "init")
+
+	superDir := t.TempDir()
+	runGit(t, superDir, "init")
+	runGit(t, superDir, "config", "protocol.file.allow", "always")
+	runGit(t, superDir, "submodule", "add", subRepoDir, "sub")
+
+	flakeDir := filepath.Join(superDir, "sub")
+	writeFlakeNix(t, flakeDir)
+
+	if err := ensureFlakeFilesTracked(flakeDir, []string{"flake.nix"}); err != nil {
+		t.Fatalf("ensureFlakeFilesTracked: %v", err)
+	}
+	assertIntentToAdd(t, flakeDir, "flake.nix")
+}
+
+// TestEnsureFlakeFilesTracked_DetachedGitDir covers a plain repo whose
+// worktree and gitdir are configured to live in unrelated directories, the
+// way `git init --separate-git-dir` or a manual `.git` file redirect would
+// set up.
+func TestEnsureFlakeFilesTracked_DetachedGitDir(t *testing.T) {
+	gitDir := t.TempDir()
+	workDir := t.TempDir()
+
+	runGit(t, workDir, "init", "--separate-git-dir", gitDir)
+	writeFlakeNix(t, workDir)
+
+	if err := ensureFlakeFilesTracked(workDir, []string{"flake.nix"}); err != nil {
+		t.Fatalf("ensureFlakeFilesTracked: %v", err)
+	}
+	assertIntentToAdd(t, workDir, "flake.nix")
+}
+
+func TestEnsureFlakeFilesTracked_NotAGitRepo(t *testing.T) {
+	dir := t.TempDir()
+	writeFlakeNix(t, dir)
+
+	if err := ensureFlakeFilesTracked(dir, []string{"flake.nix"}); err != nil {
+		t.Fatalf("expected a clean no-op outside a git repo, got: %v", err)
+	}
+}
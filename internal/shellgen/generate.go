@@ -7,17 +7,22 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
 	"go.jetpack.io/devbox/internal/boxcli/featureflag"
+	"go.jetpack.io/devbox/internal/build"
 	"go.jetpack.io/devbox/internal/cuecfg"
 	"go.jetpack.io/devbox/internal/debug"
 	"go.jetpack.io/devbox/internal/redact"
@@ -39,72 +44,215 @@ func GenerateForPrintEnv(ctx context.Context, devbox devboxer) error {
 
 	outPath := genPath(devbox)
 
-	// Preserving shell.nix to avoid breaking old-style .envrc users
-	err = writeFromTemplate(outPath, plan, "shell.nix", "shell.nix")
-	if err != nil {
-		return errors.WithStack(err)
+	group, _ := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		// Preserving shell.nix to avoid breaking old-style .envrc users
+		return writeFromTemplate(devbox, outPath, plan, "shell.nix", "shell.nix")
+	})
+	group.Go(func() error {
+		// Gitignore file is added to the .devbox directory
+		return writeFromTemplate(
+			devbox, filepath.Join(devbox.ProjectDir(), ".devbox"), plan, ".gitignore", ".gitignore")
+	})
+	if plan.needsGlibcPatch() {
+		group.Go(func() error {
+			patch, err := newGlibcPatchFlake(devbox.Config().NixPkgsCommitHash(), plan.Packages)
+			if err != nil {
+				return redact.Errorf("generate glibc patch flake: %v", err)
+			}
+			if err := patch.writeTo(filepath.Join(FlakePath(devbox), "glibc-patch")); err != nil {
+				return redact.Errorf("write glibc patch flake to directory: %v", err)
+			}
+			return nil
+		})
 	}
-
-	// Gitignore file is added to the .devbox directory
-	err = writeFromTemplate(filepath.Join(devbox.ProjectDir(), ".devbox"), plan, ".gitignore", ".gitignore")
-	if err != nil {
+	group.Go(func() error {
+		return makeFlakeFile(devbox, plan)
+	})
+	if err := group.Wait(); err != nil {
 		return errors.WithStack(err)
 	}
 
+	// glibc-patch/flake.nix is written by a goroutine above that races with
+	// makeFlakeFile, so it can't be git-tracked until both are known to have
+	// finished; track it here instead of inside makeFlakeFile.
 	if plan.needsGlibcPatch() {
-		patch, err := newGlibcPatchFlake(devbox.Config().NixPkgsCommitHash(), plan.Packages)
-		if err != nil {
-			return redact.Errorf("generate glibc patch flake: %v", err)
-		}
-		if err := patch.writeTo(filepath.Join(FlakePath(devbox), "glibc-patch")); err != nil {
-			return redact.Errorf("write glibc patch flake to directory: %v", err)
+		if err := ensureFlakeFilesTracked(FlakePath(devbox), []string{"glibc-patch/flake.nix"}); err != nil {
+			return err
 		}
 	}
-	err = makeFlakeFile(devbox, outPath, plan)
-	if err != nil {
-		return errors.WithStack(err)
-	}
 
 	return WriteScriptsToFiles(devbox)
 }
 
-// Cache and buffers for generating templated files.
+// tmplCache memoizes parsed templates across writeFromTemplate calls. It's
+// read and written concurrently by the errgroup in GenerateForPrintEnv, so
+// access must go through tmplCacheMu.
 var (
-	tmplCache = map[string]*template.Template{}
-	tmplBuf   bytes.Buffer
+	tmplCacheMu sync.Mutex
+	tmplCache   = map[string]*template.Template{}
 )
 
-func writeFromTemplate(path string, plan any, tmplName, generatedName string) error {
+func parsedTemplate(tmplName string) (*template.Template, []byte, error) {
 	tmplKey := tmplName + ".tmpl"
-	tmpl := tmplCache[tmplKey]
-	if tmpl == nil {
-		tmpl = template.New(tmplKey)
-		tmpl.Funcs(templateFuncs)
-
-		var err error
-		glob := "tmpl/" + tmplKey
-		tmpl, err = tmpl.ParseFS(tmplFS, glob)
-		if err != nil {
-			return redact.Errorf("parse embedded tmplFS glob %q: %v", redact.Safe(glob), redact.Safe(err))
-		}
-		tmplCache[tmplKey] = tmpl
+	glob := "tmpl/" + tmplKey
+
+	contents, err := fs.ReadFile(tmplFS, glob)
+	if err != nil {
+		return nil, nil, redact.Errorf("read embedded tmplFS glob %q: %v", redact.Safe(glob), redact.Safe(err))
+	}
+
+	tmplCacheMu.Lock()
+	defer tmplCacheMu.Unlock()
+
+	if tmpl := tmplCache[tmplKey]; tmpl != nil {
+		return tmpl, contents, nil
+	}
+
+	tmpl := template.New(tmplKey)
+	tmpl.Funcs(templateFuncs)
+	tmpl, err = tmpl.ParseFS(tmplFS, glob)
+	if err != nil {
+		return nil, nil, redact.Errorf("parse embedded tmplFS glob %q: %v", redact.Safe(glob), redact.Safe(err))
+	}
+	tmplCache[tmplKey] = tmpl
+	return tmpl, contents, nil
+}
+
+// writeFromTemplate renders tmplName with plan and writes it to
+// path/generatedName, unless a previous render already produced
+// byte-identical output for the same (template, plan, devbox version) and
+// outPath's on-disk content still hashes to what was written then. Each call
+// uses its own render buffer so it's safe to run concurrently, e.g. across
+// the errgroup in GenerateForPrintEnv.
+func writeFromTemplate(devbox devboxer, path string, plan any, tmplName, generatedName string) error {
+	tmpl, contents, err := parsedTemplate(tmplName)
+	if err != nil {
+		return err
 	}
-	tmplBuf.Reset()
-	if err := tmpl.Execute(&tmplBuf, plan); err != nil {
-		return redact.Errorf("execute template %s: %v", redact.Safe(tmplKey), err)
+
+	outPath := filepath.Join(path, generatedName)
+	key, err := renderCacheKey(tmplName, contents, plan)
+	if err != nil {
+		return err
+	}
+	if renderCacheHit(devbox, key, outPath, 0o644) {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, plan); err != nil {
+		return redact.Errorf("execute template %s: %v", redact.Safe(tmplName), err)
 	}
 
 	// In some circumstances, Nix looks at the mod time of a file when
 	// caching, so we only want to update the file if something has
 	// changed. Blindly overwriting the file could invalidate Nix's cache
 	// every time, slowing down evaluation considerably.
-	err := overwriteFileIfChanged(filepath.Join(path, generatedName), tmplBuf.Bytes(), 0o644)
-	if err != nil {
+	if err := overwriteFileIfChanged(outPath, buf.Bytes(), 0o644); err != nil {
 		return redact.Errorf("write %s to file: %v", redact.Safe(tmplName), err)
 	}
+	return renderCacheStore(devbox, key, outPath, buf.Bytes())
+}
+
+// renderCacheKey derives a content-addressed cache key from the template
+// name, its contents, the rendered plan, and the running devbox version, so
+// a stale cache entry can never survive a devbox upgrade or a plan change.
+func renderCacheKey(tmplName string, tmplContents []byte, plan any) (string, error) {
+	planJSON, err := cuecfg.MarshalJSON(plan)
+	if err != nil {
+		return "", redact.Errorf("marshal plan for %s render cache key: %v", redact.Safe(tmplName), err)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(tmplName))
+	h.Write(tmplContents)
+	h.Write(planJSON)
+	h.Write([]byte(build.Version))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// renderCacheDir is where per-output-file cache keys are stored, one small
+// file per generated file name.
+func renderCacheDir(devbox devboxer) string {
+	return filepath.Join(devbox.ProjectDir(), ".devbox", "gen", ".cache")
+}
+
+// renderCacheHit reports whether outPath already holds the render for key:
+// the stored key file's key matches, outPath exists with the expected
+// permissions, and outPath's current content still hashes to what the cache
+// entry recorded. That last check catches an outPath that was hand-edited,
+// truncated by a crashed run, or otherwise changed on disk without the
+// template/plan/devbox version changing -- otherwise it would read as a
+// cache hit forever and leave the wrong content in place.
+func renderCacheHit(devbox devboxer, key, outPath string, perm os.FileMode) bool {
+	stored, err := os.ReadFile(renderCacheKeyPath(devbox, outPath))
+	if err != nil {
+		return false
+	}
+	storedKey, storedContentHash, ok := splitRenderCacheEntry(stored)
+	if !ok || storedKey != key {
+		return false
+	}
+
+	fi, err := os.Stat(outPath)
+	if err != nil || fi.Mode().Perm() != perm {
+		return false
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		return false
+	}
+	return sha256Hex(data) == storedContentHash
+}
+
+// renderCacheStore atomically records key, and the hash of data (outPath's
+// just-written content), as the cache entry for outPath.
+func renderCacheStore(devbox devboxer, key, outPath string, data []byte) error {
+	keyPath := renderCacheKeyPath(devbox, outPath)
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0o755); err != nil {
+		return redact.Errorf("create render cache dir: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(keyPath), filepath.Base(keyPath)+".tmp-*")
+	if err != nil {
+		return redact.Errorf("create render cache key temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(key + "\n" + sha256Hex(data)); err != nil {
+		tmp.Close()
+		return redact.Errorf("write render cache key: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return redact.Errorf("close render cache key temp file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), keyPath); err != nil {
+		return redact.Errorf("rename render cache key into place: %v", err)
+	}
 	return nil
 }
 
+// splitRenderCacheEntry parses a render cache key file's "<key>\n<content
+// hash>" format.
+func splitRenderCacheEntry(stored []byte) (key, contentHash string, ok bool) {
+	parts := strings.SplitN(string(stored), "\n", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func renderCacheKeyPath(devbox devboxer, outPath string) string {
+	return filepath.Join(renderCacheDir(devbox), filepath.Base(outPath)+".key")
+}
+
 // writeGlibcPatchScript writes the embedded glibc patching script to disk so
 // that a generated flake can use it.
 func writeGlibcPatchScript(path string) error {
@@ -184,68 +332,20 @@ var templateFuncs = template.FuncMap{
 	"debug":    debug.IsEnabled,
 }
 
-func makeFlakeFile(d devboxer, outPath string, plan *flakePlan) error {
+func makeFlakeFile(d devboxer, plan *flakePlan) error {
 	flakeDir := FlakePath(d)
 	templateName := "flake.nix"
 	if featureflag.RemoveNixpkgs.Enabled() {
 		templateName = "flake_remove_nixpkgs.nix"
 	}
-	err := writeFromTemplate(flakeDir, plan, templateName, "flake.nix")
+	err := writeFromTemplate(d, flakeDir, plan, templateName, "flake.nix")
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	if !isProjectInGitRepo(outPath) {
-		// if we are not in a git repository, then carry on
-		return nil
-	}
-	// if we are in a git repository, then nix requires that the flake.nix file be tracked by git
-
-	// make an empty git repo
-	// Alternatively consider: git add intent-to-add path/to/flake.nix, and
-	// git update-index --assume-unchanged path/to/flake.nix
-	// https://nixos.wiki/wiki/Flakes#How_to_add_a_file_locally_in_git_but_not_include_it_in_commits
-	cmd := exec.Command("git", "-C", flakeDir, "init")
-	if debug.IsEnabled() {
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-	}
-	err = cmd.Run()
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	// Any files that flake.nix needs at build time must be in git.
-	// Otherwise, Nix won't copy it into the flake's build environment.
-	cmd = exec.Command("git", "-C", flakeDir, "add", "flake.nix")
-	if plan.needsGlibcPatch() {
-		cmd.Args = append(cmd.Args, "glibc-patch/flake.nix")
-	}
-	if debug.IsEnabled() {
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-	}
-	return errors.WithStack(cmd.Run())
-}
-
-func isProjectInGitRepo(dir string) bool {
-	for dir != "/" {
-		// Look for a .git directory in `dir`
-		_, err := os.Stat(filepath.Join(dir, ".git"))
-		if err == nil {
-			// Found a .git
-			return true
-		}
-		if !errors.Is(err, fs.ErrNotExist) {
-			// An error means we will not find a git repo so return false
-			return false
-		}
-		// No .git directory found, so loop again into the parent dir
-		dir = filepath.Dir(dir)
-	}
-	// We reached the fs-root dir, climbed the highest mountain and
-	// we still haven't found what we're looking for.
-	return false
+	// Nix requires that flake.nix (and anything it needs at build time) be
+	// tracked by git, wherever the project's enclosing git repo actually is.
+	// glibc-patch/flake.nix, if any, is tracked separately by the caller once
+	// it's known to have been written.
+	return ensureFlakeFilesTracked(flakeDir, []string{"flake.nix"})
 }
@@ -0,0 +1,145 @@
+// Copyright 2023 Jetpack Technologies Inc and contributors. All rights reserved.
+// Use of this source code is governed by the license in the LICENSE file.
+
+package shellgen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderCacheKey_StableForSameInputs(t *testing.T) {
+	plan := map[string]string{"a": "1"}
+	contents := []byte("template contents")
+
+	key1, err := renderCacheKey("shell.nix", contents, plan)
+	if err != nil {
+		t.Fatalf("renderCacheKey: %v", err)
+	}
+	key2, err := renderCacheKey("shell.nix", contents, plan)
+	if err != nil {
+		t.Fatalf("renderCacheKey: %v", err)
+	}
+	if key1 != key2 {
+		t.Fatalf("got different keys %q and %q for identical inputs", key1, key2)
+	}
+}
+
+func TestRenderCacheKey_ChangesWithInputs(t *testing.T) {
+	base, err := renderCacheKey("shell.nix", []byte("v1"), map[string]string{"a": "1"})
+	if err != nil {
+		t.Fatalf("renderCacheKey: %v", err)
+	}
+
+	cases := map[string]string{}
+	withDifferentTmplName, err := renderCacheKey("flake.nix", []byte("v1"), map[string]string{"a": "1"})
+	if err != nil {
+		t.Fatalf("renderCacheKey: %v", err)
+	}
+	cases["template name"] = withDifferentTmplName
+
+	withDifferentContents, err := renderCacheKey("shell.nix", []byte("v2"), map[string]string{"a": "1"})
+	if err != nil {
+		t.Fatalf("renderCacheKey: %v", err)
+	}
+	cases["template contents"] = withDifferentContents
+
+	withDifferentPlan, err := renderCacheKey("shell.nix", []byte("v1"), map[string]string{"a": "2"})
+	if err != nil {
+		t.Fatalf("renderCacheKey: %v", err)
+	}
+	cases["plan"] = withDifferentPlan
+
+	for name, got := range cases {
+		if got == base {
+			t.Errorf("changing %s did not change the cache key", name)
+		}
+	}
+}
+
+func TestOverwriteFileIfChanged_SkipsIdenticalContent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flake.nix")
+	content := []byte("unchanged contents\n")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := overwriteFileIfChanged(path, content, 0o644); err != nil {
+		t.Fatalf("overwriteFileIfChanged: %v", err)
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !before.ModTime().Equal(after.ModTime()) {
+		t.Errorf("file was rewritten even though its contents were unchanged")
+	}
+}
+
+func TestOverwriteFileIfChanged_RewritesDifferentContent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flake.nix")
+	if err := os.WriteFile(path, []byte("old contents\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte("new contents\n")
+	if err := overwriteFileIfChanged(path, want, 0o644); err != nil {
+		t.Fatalf("overwriteFileIfChanged: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got contents %q, want %q", got, want)
+	}
+}
+
+// TestSplitRenderCacheEntry_RoundTrip guards the format renderCacheStore
+// writes and renderCacheHit reads back: a key and a content hash joined by a
+// newline, so renderCacheHit can catch an outPath whose content changed
+// without the key changing (e.g. a hand edit or a truncated previous run).
+func TestSplitRenderCacheEntry_RoundTrip(t *testing.T) {
+	wantKey := "abc123"
+	wantHash := sha256Hex([]byte("rendered contents"))
+
+	key, hash, ok := splitRenderCacheEntry([]byte(wantKey + "\n" + wantHash))
+	if !ok {
+		t.Fatalf("splitRenderCacheEntry reported not ok for a well-formed entry")
+	}
+	if key != wantKey || hash != wantHash {
+		t.Fatalf("got (%q, %q), want (%q, %q)", key, hash, wantKey, wantHash)
+	}
+}
+
+func TestSplitRenderCacheEntry_RejectsMalformed(t *testing.T) {
+	if _, _, ok := splitRenderCacheEntry([]byte("just-a-key-no-hash")); ok {
+		t.Fatalf("expected a legacy entry with no content hash to be rejected")
+	}
+}
+
+func TestOverwriteFileIfChanged_CreatesMissingDirs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "dir", "flake.nix")
+	want := []byte("contents\n")
+
+	if err := overwriteFileIfChanged(path, want, 0o644); err != nil {
+		t.Fatalf("overwriteFileIfChanged: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got contents %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright 2023 Jetpack Technologies Inc and contributors. All rights reserved.
+// Use of this source code is governed by the license in the LICENSE file.
+
+package shellgen
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/trace"
+	"strings"
+	"text/template"
+
+	"github.com/blakesmith/ar"
+	"go.jetpack.io/devbox/internal/nix"
+	"go.jetpack.io/devbox/internal/redact"
+)
+
+// IPKOptions configures the package produced by GenerateIPK.
+type IPKOptions struct {
+	// Architecture is the OpenWrt/Yocto target architecture (e.g. "mips_24kc",
+	// "aarch64_cortex-a53") recorded in the control file.
+	Architecture string
+	// OutputPath is the file path the .ipk is written to.
+	OutputPath string
+}
+
+// GenerateIPK produces an installable IPK package from a devbox project's
+// resolved Nix profile, so the environment can be shipped to OpenWrt/Yocto
+// based embedded devices that don't run Nix. It walks nix.ProfileList for
+// profilePath, materializes every store path's runtime closure into a
+// staging tree, and emits an ar-format .ipk containing debian-binary,
+// control.tar.gz, and data.tar.gz.
+func GenerateIPK(ctx context.Context, devbox devboxer, profilePath string, opts IPKOptions) error {
+	defer trace.StartRegion(ctx, "GenerateIPK").End()
+
+	storePaths, err := ipkStorePaths(profilePath)
+	if err != nil {
+		return err
+	}
+
+	stagingDir, err := os.MkdirTemp("", "devbox-ipk-")
+	if err != nil {
+		return redact.Errorf("create ipk staging dir: %v", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	for _, storePath := range storePaths {
+		if err := ipkStageClosure(ctx, storePath, stagingDir); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(opts.OutputPath), 0o755); err != nil {
+		return redact.Errorf("create ipk output dir: %v", err)
+	}
+	out, err := os.Create(opts.OutputPath)
+	if err != nil {
+		return redact.Errorf("create ipk output file %s: %v", redact.Safe(opts.OutputPath), err)
+	}
+	defer out.Close()
+
+	return ipkWriteArchive(out, devbox, stagingDir, opts)
+}
+
+// ipkStorePaths resolves the store paths that make up profilePath's current
+// generation by shelling out to `nix profile list --json`.
+func ipkStorePaths(profilePath string) ([]string, error) {
+	var buf bytes.Buffer
+	raw, err := nix.ProfileList(&buf, profilePath, true /* useJSON */)
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Elements []struct {
+			StorePaths []string `json:"storePaths"`
+		} `json:"elements"`
+	}
+	if err := json.Unmarshal([]byte(raw), &list); err != nil {
+		return nil, redact.Errorf("parse nix profile list output: %v", err)
+	}
+
+	var paths []string
+	for _, elem := range list.Elements {
+		paths = append(paths, elem.StorePaths...)
+	}
+	return paths, nil
+}
+
+// ipkStageClosure copies storePath and its full runtime closure into
+// stagingDir, preserving the /nix/store/<hash>-<name> layout so that
+// anything the closure execs or dlopens at a hardcoded store path keeps
+// working on the target device.
+func ipkStageClosure(ctx context.Context, storePath, stagingDir string) error {
+	cmd := exec.CommandContext(ctx, "nix-store", "--query", "--requisites", storePath)
+	out, err := cmd.Output()
+	if err != nil {
+		return redact.Errorf("query closure of %s: %v", redact.Safe(storePath), err)
+	}
+
+	for _, p := range strings.Fields(string(out)) {
+		dst := filepath.Join(stagingDir, p)
+		if _, err := os.Lstat(dst); err == nil {
+			continue // already staged as part of an earlier closure
+		}
+		if err := copyTree(p, dst); err != nil {
+			return redact.Errorf("stage closure path %s: %v", redact.Safe(p), err)
+		}
+	}
+	return nil
+}
+
+// copyTree recursively copies src to dst, preserving file modes and
+// symlinks. It's a plain Go walk rather than shelling out to `cp`, since
+// GNU coreutils flags like `--reflink` aren't available on BSD/macOS `cp`
+// and devbox supports both.
+func copyTree(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+
+	case info.IsDir():
+		if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyTree(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, in)
+		return err
+	}
+}
+
+type ipkControlInfo struct {
+	Package      string
+	Version      string
+	Architecture string
+	Description  string
+}
+
+// Intentionally no Depends field: the package already embeds its full
+// resolved Nix closure as data.tar.gz, so it has no real dependency on
+// anything else in an opkg/Yocto feed. Devbox/Nix package identifiers (which
+// can contain characters like @ and # that Depends doesn't support) would
+// only confuse opkg's dependency resolution without conveying anything
+// useful.
+var ipkControlTmpl = template.Must(template.New("control").Parse(
+	`Package: {{.Package}}
+Version: {{.Version}}
+Architecture: {{.Architecture}}
+Description: {{.Description}}
+`))
+
+// ipkWriteArchive writes the final ar(1) archive -- debian-binary,
+// control.tar.gz, data.tar.gz, in that order -- to w.
+func ipkWriteArchive(w io.Writer, devbox devboxer, stagingDir string, opts IPKOptions) error {
+	control, err := ipkBuildControlInfo(devbox, opts)
+	if err != nil {
+		return err
+	}
+
+	controlTgz, err := ipkBuildControlTar(control, devbox.Config().InitHookCmds())
+	if err != nil {
+		return err
+	}
+
+	dataTgz, err := ipkBuildDataTar(stagingDir)
+	if err != nil {
+		return err
+	}
+
+	aw := ar.NewWriter(w)
+	if err := aw.WriteGlobalHeader(); err != nil {
+		return redact.Errorf("write ar global header: %v", err)
+	}
+
+	entries := []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlTgz},
+		{"data.tar.gz", dataTgz},
+	}
+	for _, e := range entries {
+		hdr := &ar.Header{
+			Name: e.name,
+			Mode: 0o644,
+			Size: int64(len(e.data)),
+		}
+		if err := aw.WriteHeader(hdr); err != nil {
+			return redact.Errorf("write ar header for %s: %v", redact.Safe(e.name), err)
+		}
+		if _, err := aw.Write(e.data); err != nil {
+			return redact.Errorf("write ar entry %s: %v", redact.Safe(e.name), err)
+		}
+	}
+
+	// Intentionally no MD5Sums file inside the package: integrity is
+	// verified via the SHA256 recorded in the outer feed's Packages index,
+	// not via opkg's legacy per-file MD5Sum mechanism.
+	return nil
+}
+
+func ipkBuildControlInfo(devbox devboxer, opts IPKOptions) (ipkControlInfo, error) {
+	cfg := devbox.Config()
+	name := filepath.Base(devbox.ProjectDir())
+
+	lock, err := readLockfile(devbox)
+	version := "0.0.0"
+	if err == nil && lock != "" {
+		version = lock
+	}
+
+	return ipkControlInfo{
+		Package:      name,
+		Version:      version,
+		Architecture: opts.Architecture,
+		Description: fmt.Sprintf(
+			"devbox environment for %s, exported by `devbox export ipk`; packages: %s",
+			name, strings.Join(cfg.PackageNames(), ", "),
+		),
+	}, nil
+}
+
+// ipkBuildControlTar renders control.tar.gz. When initHookCmds is non-empty,
+// the devbox init_hook is carried over verbatim as the package's postinst
+// script so it still runs once the environment lands on the target device.
+func ipkBuildControlTar(control ipkControlInfo, initHookCmds []string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := ipkTarGzip(&buf, func(tw *tar.Writer) error {
+		var controlBuf bytes.Buffer
+		if err := ipkControlTmpl.Execute(&controlBuf, control); err != nil {
+			return redact.Errorf("render control file: %v", err)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name: "./control",
+			Mode: 0o644,
+			Size: int64(controlBuf.Len()),
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(controlBuf.Bytes()); err != nil {
+			return err
+		}
+
+		if len(initHookCmds) == 0 {
+			return nil
+		}
+		postinst := "#!/bin/sh\nset -e\n" + strings.Join(initHookCmds, "\n") + "\n"
+		if err := tw.WriteHeader(&tar.Header{
+			Name: "./postinst",
+			Mode: 0o755,
+			Size: int64(len(postinst)),
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write([]byte(postinst))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func ipkBuildDataTar(stagingDir string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := ipkTarGzip(&buf, func(tw *tar.Writer) error {
+		return filepath.Walk(stagingDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(stagingDir, path)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = "./" + filepath.ToSlash(rel)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if info.IsDir() || link != "" {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func ipkTarGzip(buf *bytes.Buffer, write func(*tar.Writer) error) error {
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	if err := write(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// readLockfile returns a short content hash of the project's devbox.lock so
+// the control file's Version field changes whenever resolved packages do.
+func readLockfile(devbox devboxer) (string, error) {
+	data, err := os.ReadFile(filepath.Join(devbox.ProjectDir(), "devbox.lock"))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12], nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2023 Jetpack Technologies Inc and contributors. All rights reserved.
+// Use of this source code is governed by the license in the LICENSE file.
+
+package shellgen
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readTar returns every entry name to its contents in a gzipped tar, for
+// asserting on ipkBuildControlTar/ipkBuildDataTar output without needing an
+// `ar`/`tar` binary on PATH.
+func readTar(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	entries := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar.Next: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read tar entry %s: %v", hdr.Name, err)
+		}
+		entries[hdr.Name] = content
+	}
+	return entries
+}
+
+func TestIpkBuildControlTar_NoInitHook(t *testing.T) {
+	control := ipkControlInfo{
+		Package:      "my-env",
+		Version:      "abc123",
+		Architecture: "mips_24kc",
+		Description:  "devbox environment for my-env",
+	}
+
+	data, err := ipkBuildControlTar(control, nil)
+	if err != nil {
+		t.Fatalf("ipkBuildControlTar: %v", err)
+	}
+
+	entries := readTar(t, data)
+	if _, ok := entries["./postinst"]; ok {
+		t.Fatalf("expected no postinst script when there's no init_hook")
+	}
+
+	controlFile, ok := entries["./control"]
+	if !ok {
+		t.Fatalf("expected a ./control entry, got %v", entries)
+	}
+	want := []string{
+		"Package: my-env",
+		"Version: abc123",
+		"Architecture: mips_24kc",
+		"Description: devbox environment for my-env",
+	}
+	for _, line := range want {
+		if !strings.Contains(string(controlFile), line) {
+			t.Errorf("control file missing %q, got:\n%s", line, controlFile)
+		}
+	}
+	if strings.Contains(string(controlFile), "Depends:") {
+		t.Errorf("control file should not have a Depends line (package is self-contained), got:\n%s", controlFile)
+	}
+}
+
+func TestIpkBuildControlTar_WithInitHook(t *testing.T) {
+	control := ipkControlInfo{
+		Package:      "my-env",
+		Version:      "abc123",
+		Architecture: "aarch64_cortex-a53",
+		Description:  "devbox environment for my-env; packages: libc, zlib",
+	}
+
+	data, err := ipkBuildControlTar(control, []string{"echo hello", "touch /tmp/ready"})
+	if err != nil {
+		t.Fatalf("ipkBuildControlTar: %v", err)
+	}
+
+	entries := readTar(t, data)
+	controlFile, ok := entries["./control"]
+	if !ok {
+		t.Fatalf("expected a ./control entry, got %v", entries)
+	}
+	if strings.Contains(string(controlFile), "Depends:") {
+		t.Errorf("control file should not have a Depends line (package is self-contained), got:\n%s", controlFile)
+	}
+
+	postinst, ok := entries["./postinst"]
+	if !ok {
+		t.Fatalf("expected a ./postinst entry carrying init_hook, got %v", entries)
+	}
+	for _, cmd := range []string{"echo hello", "touch /tmp/ready"} {
+		if !strings.Contains(string(postinst), cmd) {
+			t.Errorf("postinst missing init_hook command %q, got:\n%s", cmd, postinst)
+		}
+	}
+}
+
+func TestIpkBuildDataTar(t *testing.T) {
+	stagingDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(stagingDir, "nix", "store", "abc-pkg", "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	binPath := filepath.Join(stagingDir, "nix", "store", "abc-pkg", "bin", "tool")
+	if err := os.WriteFile(binPath, []byte("#!/bin/sh\necho hi\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(binPath, filepath.Join(stagingDir, "tool-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ipkBuildDataTar(stagingDir)
+	if err != nil {
+		t.Fatalf("ipkBuildDataTar: %v", err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	var sawBin, sawLink bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar.Next: %v", err)
+		}
+		switch hdr.Name {
+		case "./nix/store/abc-pkg/bin/tool":
+			sawBin = true
+			content, _ := io.ReadAll(tr)
+			if !strings.Contains(string(content), "echo hi") {
+				t.Errorf("unexpected tool contents: %s", content)
+			}
+			if hdr.Mode&0o111 == 0 {
+				t.Errorf("expected tool to stay executable, mode was %o", hdr.Mode)
+			}
+		case "./tool-link":
+			sawLink = true
+			if hdr.Typeflag != tar.TypeSymlink {
+				t.Errorf("expected tool-link to be a symlink entry, got typeflag %v", hdr.Typeflag)
+			}
+		}
+	}
+	if !sawBin {
+		t.Errorf("expected staged binary in data.tar.gz")
+	}
+	if !sawLink {
+		t.Errorf("expected symlink in data.tar.gz")
+	}
+}
+
+func TestCopyTree_PreservesSymlinksAndModes(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := filepath.Join(t.TempDir(), "copy")
+
+	if err := os.MkdirAll(filepath.Join(srcDir, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "bin", "tool"), []byte("data"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("tool", filepath.Join(srcDir, "bin", "tool-alias")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyTree(srcDir, dstDir); err != nil {
+		t.Fatalf("copyTree: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dstDir, "bin", "tool"))
+	if err != nil {
+		t.Fatalf("read copied file: %v", err)
+	}
+	if string(content) != "data" {
+		t.Errorf("got copied content %q, want %q", content, "data")
+	}
+
+	fi, err := os.Stat(filepath.Join(dstDir, "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o750 {
+		t.Errorf("got mode %o, want %o", fi.Mode().Perm(), 0o750)
+	}
+
+	target, err := os.Readlink(filepath.Join(dstDir, "bin", "tool-alias"))
+	if err != nil {
+		t.Fatalf("expected tool-alias to stay a symlink: %v", err)
+	}
+	if target != "tool" {
+		t.Errorf("got symlink target %q, want %q", target, "tool")
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2023 Jetpack Technologies Inc and contributors. All rights reserved.
+// Use of this source code is governed by the license in the LICENSE file.
+
+// Package snapshot captures the state produced by shellgen.GenerateForPrintEnv
+// and nix.ProfileInstall into a single portable manifest, modeled on the
+// project-pinning manifests used by multi-repo tools. A committed
+// devbox.snapshot.json lets a team get byte-identical rebuilds across
+// machines and fast CI restoration without re-evaluating the flake.
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"go.jetpack.io/devbox"
+	"go.jetpack.io/devbox/internal/nix"
+	"go.jetpack.io/devbox/internal/redact"
+	"go.jetpack.io/devbox/internal/shellgen"
+)
+
+// FileName is the conventional name for a committed snapshot manifest,
+// expected to live alongside devbox.lock.
+const FileName = "devbox.snapshot.json"
+
+// Element pins a single profile element: the flake input that produced it,
+// the store path Nix resolved it to, the priority it was installed with, and
+// the narHash of that store path.
+type Element struct {
+	FlakeRef  string `json:"flake_ref"`
+	StorePath string `json:"store_path"`
+	Priority  int    `json:"priority"`
+	NarHash   string `json:"nar_hash"`
+}
+
+// Snapshot is the root of a devbox.snapshot.json manifest.
+type Snapshot struct {
+	// Elements are recorded in the deterministic order nix.ProfileManifest
+	// returns them in (by Priority then AttrPath), so re-Build-ing an
+	// unchanged profile always produces a byte-identical manifest. Restore
+	// pins each element's own recorded Priority when reinstalling it, so
+	// this order doesn't need to match the order they're re-installed in.
+	Elements []Element `json:"elements"`
+	// GeneratedFiles maps a path under .devbox/gen/ (relative to the
+	// project directory) to the SHA256 of its contents at snapshot time.
+	GeneratedFiles map[string]string `json:"generated_files"`
+}
+
+// Build captures devbox's current profile and generated files into a
+// Snapshot. It assumes GenerateForPrintEnv and the profile install have
+// already run against box.
+func Build(ctx context.Context, box *devbox.Devbox) (*Snapshot, error) {
+	manifestElements, err := nix.ProfileManifest(box.ProfileDir())
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{
+		Elements:       make([]Element, 0, len(manifestElements)),
+		GeneratedFiles: map[string]string{},
+	}
+	for _, e := range manifestElements {
+		storePath := ""
+		if len(e.StorePaths) > 0 {
+			storePath = e.StorePaths[0]
+		}
+		narHash, err := narHash(ctx, storePath)
+		if err != nil {
+			return nil, err
+		}
+		snap.Elements = append(snap.Elements, Element{
+			FlakeRef:  e.FlakeRef,
+			StorePath: storePath,
+			Priority:  e.Priority,
+			NarHash:   narHash,
+		})
+	}
+
+	genDir := filepath.Join(box.ProjectDir(), ".devbox", "gen")
+	if err := filepath.WalkDir(genDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) == ".key" {
+			return nil
+		}
+		rel, err := filepath.Rel(box.ProjectDir(), path)
+		if err != nil {
+			return err
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		snap.GeneratedFiles[filepath.ToSlash(rel)] = sum
+		return nil
+	}); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, redact.Errorf("walk generated files: %v", err)
+	}
+
+	return snap, nil
+}
+
+// Write marshals the snapshot as indented JSON to path.
+func (s *Snapshot) Write(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return redact.Errorf("marshal snapshot: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return redact.Errorf("write snapshot to %s: %v", redact.Safe(path), err)
+	}
+	return nil
+}
+
+// Load reads a snapshot manifest from path.
+func Load(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, redact.Errorf("read snapshot %s: %v", redact.Safe(path), err)
+	}
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, redact.Errorf("parse snapshot %s: %v", redact.Safe(path), err)
+	}
+	return &s, nil
+}
+
+// Drift describes a single mismatch found by Verify.
+type Drift struct {
+	Path   string
+	Reason string
+}
+
+// Verify compares the snapshot against the current state of projectDir and
+// returns every mismatch found. An empty result means disk state exactly
+// matches what was snapshotted.
+func (s *Snapshot) Verify(projectDir string) ([]Drift, error) {
+	var drifts []Drift
+
+	paths := make([]string, 0, len(s.GeneratedFiles))
+	for rel := range s.GeneratedFiles {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	for _, rel := range paths {
+		wantSum := s.GeneratedFiles[rel]
+		sum, err := fileSHA256(filepath.Join(projectDir, rel))
+		if errors.Is(err, fs.ErrNotExist) {
+			drifts = append(drifts, Drift{Path: rel, Reason: "missing"})
+			continue
+		}
+		if err != nil {
+			return nil, redact.Errorf("hash %s: %v", redact.Safe(rel), err)
+		}
+		if sum != wantSum {
+			drifts = append(drifts, Drift{Path: rel, Reason: "content changed"})
+		}
+	}
+	return drifts, nil
+}
+
+// Restore re-installs every recorded element into box's profile, at the
+// exact priority they were snapshotted with, then regenerates the files
+// under .devbox/gen/ and confirms they came back byte-identical to what was
+// snapshotted.
+func (s *Snapshot) Restore(ctx context.Context, box *devbox.Devbox) error {
+	batch := make([]*nix.ProfileInstallArgs, len(s.Elements))
+	for i := range s.Elements {
+		priority := s.Elements[i].Priority
+		batch[i] = &nix.ProfileInstallArgs{
+			Installable: s.Elements[i].FlakeRef,
+			ProfilePath: box.ProfileDir(),
+			Writer:      os.Stderr,
+			// Pin the exact priority this element was snapshotted with,
+			// instead of letting ProfileInstallBatch assign a fresh one.
+			Priority: &priority,
+		}
+	}
+	if err := nix.ProfileInstallBatch(ctx, batch); err != nil {
+		return redact.Errorf("restore profile: %v", err)
+	}
+
+	if err := shellgen.GenerateForPrintEnv(ctx, box); err != nil {
+		return redact.Errorf("regenerate files: %v", err)
+	}
+
+	drifts, err := s.Verify(box.ProjectDir())
+	if err != nil {
+		return err
+	}
+	if len(drifts) > 0 {
+		return redact.Errorf(
+			"restored environment does not match snapshot for %d file(s); "+
+				"this usually means the pinned store paths are no longer reproducible",
+			redact.Safe(len(drifts)),
+		)
+	}
+	return nil
+}
+
+func narHash(ctx context.Context, storePath string) (string, error) {
+	if storePath == "" {
+		return "", nil
+	}
+	out, err := exec.CommandContext(ctx, "nix", "path-info", "--json", storePath).Output()
+	if err != nil {
+		return "", redact.Errorf("nix path-info %s: %v", redact.Safe(storePath), err)
+	}
+
+	var infos []struct {
+		NarHash string `json:"narHash"`
+	}
+	if err := json.Unmarshal(out, &infos); err != nil || len(infos) == 0 {
+		return "", redact.Errorf("parse nix path-info output for %s: %v", redact.Safe(storePath), err)
+	}
+	return infos[0].NarHash, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Jetpack Technologies Inc and contributors. All rights reserved.
+// Use of this source code is governed by the license in the LICENSE file.
+
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteLoad_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, FileName)
+
+	want := &Snapshot{
+		Elements: []Element{
+			{FlakeRef: "flake:a", StorePath: "/nix/store/aaa-a", Priority: 5, NarHash: "sha256-aaa"},
+			{FlakeRef: "flake:b", StorePath: "/nix/store/bbb-b", Priority: 7, NarHash: "sha256-bbb"},
+		},
+		GeneratedFiles: map[string]string{
+			".devbox/gen/flake.nix": "deadbeef",
+		},
+	}
+
+	if err := want.Write(path); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if len(got.Elements) != len(want.Elements) {
+		t.Fatalf("got %d elements, want %d", len(got.Elements), len(want.Elements))
+	}
+	for i := range want.Elements {
+		if got.Elements[i] != want.Elements[i] {
+			t.Errorf("element %d: got %#v, want %#v", i, got.Elements[i], want.Elements[i])
+		}
+	}
+	if len(got.GeneratedFiles) != len(want.GeneratedFiles) {
+		t.Fatalf("got %d generated files, want %d", len(got.GeneratedFiles), len(want.GeneratedFiles))
+	}
+	for rel, sum := range want.GeneratedFiles {
+		if got.GeneratedFiles[rel] != sum {
+			t.Errorf("generated file %s: got sum %q, want %q", rel, got.GeneratedFiles[rel], sum)
+		}
+	}
+}
+
+func TestSnapshot_Verify_NoDrift(t *testing.T) {
+	projectDir := t.TempDir()
+	genPath := filepath.Join(projectDir, ".devbox", "gen", "flake.nix")
+	if err := os.MkdirAll(filepath.Dir(genPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("flake contents\n")
+	if err := os.WriteFile(genPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := fileSHA256(genPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Snapshot{GeneratedFiles: map[string]string{".devbox/gen/flake.nix": sum}}
+
+	drifts, err := s.Verify(projectDir)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if len(drifts) != 0 {
+		t.Fatalf("got drifts %#v, want none", drifts)
+	}
+}
+
+func TestSnapshot_Verify_MissingAndChanged(t *testing.T) {
+	projectDir := t.TempDir()
+	changedPath := filepath.Join(projectDir, ".devbox", "gen", "shell.nix")
+	if err := os.MkdirAll(filepath.Dir(changedPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(changedPath, []byte("new contents\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Snapshot{
+		GeneratedFiles: map[string]string{
+			".devbox/gen/shell.nix":   "sha256-of-old-contents",
+			".devbox/gen/missing.nix": "sha256-of-something",
+		},
+	}
+
+	drifts, err := s.Verify(projectDir)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if len(drifts) != 2 {
+		t.Fatalf("got %d drifts, want 2: %#v", len(drifts), drifts)
+	}
+
+	byPath := map[string]string{}
+	for _, d := range drifts {
+		byPath[d.Path] = d.Reason
+	}
+	if byPath[".devbox/gen/shell.nix"] != "content changed" {
+		t.Errorf("got reason %q for shell.nix, want %q", byPath[".devbox/gen/shell.nix"], "content changed")
+	}
+	if byPath[".devbox/gen/missing.nix"] != "missing" {
+		t.Errorf("got reason %q for missing.nix, want %q", byPath[".devbox/gen/missing.nix"], "missing")
+	}
+}